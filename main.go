@@ -2,11 +2,16 @@ package main
 
 import (
 	"os"
+	"log"
+	"appinfo"
 	"jsonconfig"
 	"database"
 	"generator"
 	"flag"
 	"config"
+	"context"
+	"fmt"
+	"strings"
 )
 
 
@@ -17,11 +22,42 @@ func main() {
 
 	// Get flag -s(sample data)
 	includeSample := flag.Bool("s", false, "a bool")
+	// Get flag -offline(generate from AppInfo without a database)
+	offline := flag.Bool("offline", false, "generate from AppInfo in config.json without a database")
+	// Get flag -i(introspect existing schema)
+	introspect := flag.Bool("i", false, "fill metadata tables from the existing database schema")
+	// Get flags -out and -module(where generated code goes)
+	outputDir := flag.String("out", "", "directory the application is generated in, current directory if empty")
+	modulePath := flag.String("module", "", "go module path of the generated application, GOPATH vendor layout if empty")
+	// Get flag -dry-run(diff instead of writing)
+	dryRun := flag.Bool("dry-run", false, "print a diff of the generated code against the disk without writing, exit status 3 when it is stale")
+	// Get flag -verify(type check generated code)
+	verify := flag.Bool("verify", false, "parse and type check the generated code and report its problems")
+	// Get flag -templates(artifact template overrides)
+	templateDir := flag.String("templates", "", "directory of <artifact>.tmpl files overriding generated artifacts")
+	// Get flag -force(ignore the manifest)
+	force := flag.Bool("force", false, "regenerate every entity, even those unchanged since the previous generation")
+	// Get flag -emit(generation targets)
+	emit := flag.String("emit", "", "comma separated emitters to run, among "+strings.Join(generator.EmitterNames(), ", ")+", "+strings.Join(generator.DefaultEmitters, ",")+" if empty")
 	flag.Parse()
 
 	// Load the configuration file
 	jsonconfig.Load("config"+string(os.PathSeparator)+"config.json", con)
 
+	opts := generator.Config{AppName: con.AppInfo.Name, OutputDir: *outputDir, ModulePath: *modulePath, DryRun: *dryRun, Verify: *verify, TemplateDir: *templateDir, Force: *force, Irregulars: con.AppInfo.Irregulars, MaxPageSize: con.AppInfo.MaxPageSize}
+	if *emit != "" {
+		opts.Emitters = strings.Split(*emit, ",")
+	}
+
+	if *offline {
+		if err := generator.ValidateAppInfo(con.AppInfo); err != nil {
+			log.Fatal(err)
+		}
+		opts.Source = generator.AppInfoSource{App: con.AppInfo}
+		generate(opts)
+		return
+	}
+
 	// Connect to database
 	database.Connect(con.Database)
 
@@ -33,47 +69,130 @@ func main() {
 		&generator.RelationType{})
 
 	upsertRelationTypes()
+	if *introspect {
+		app, err := generator.Introspect(generator.MySQLSchemaReader{DB: database.SQL, Schema: con.Database.MySQL.Name})
+		if err != nil {
+			log.Fatal("Cannot introspect database ", err)
+		}
+		if err := generator.ValidateAppInfo(app); err != nil {
+			log.Fatal(err)
+		}
+		if err := upsertSampleData(&app); err != nil {
+			log.Fatal(err)
+		}
+	}
 	if *includeSample {
-		upsertSampleData()
+		if err := generator.ValidateAppInfo(con.AppInfo); err != nil {
+			log.Fatal(err)
+		}
+		if err := upsertSampleData(&con.AppInfo); err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	generator.GenerateCode(con.AppInfo.Name)
+	opts.Source = generator.DatabaseSource{DB: database.SQL}
+	generate(opts)
+}
+
+func generate(opts generator.Config) {
+	result, err := generator.Generate(context.Background(), opts)
+	for _, issue := range result.Issues {
+		fmt.Println(issue)
+	}
+	if opts.DryRun {
+		for _, change := range result.Changes {
+			fmt.Print(change.Diff)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		if result.Stale() {
+			fmt.Println(len(result.Changes), "generated files are stale")
+			os.Exit(3)
+		}
+		return
+	}
+	for _, name := range result.Skipped {
+		fmt.Println(name, "unchanged")
+	}
+	for _, file := range result.Files {
+		fmt.Println(file, "generated")
+	}
+	for _, file := range result.Removed {
+		fmt.Println(file, "removed")
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("=========================")
+	fmt.Println(opts.AppName, "generated!!!")
 }
 
-func upsertSampleData() {
-	app := &con.AppInfo
+func upsertSampleData(app *appinfo.AppInfo) error {
 
 	if app == nil {
-		return
+		return nil
 	}
 
+	//field types are found by name, new ones get the next free id of c_column_type,
+	//so ids of the config are mapped to the stored ones
+	typeIDs := map[int]int{}
 	for _, val := range app.FieldTypes {
-		colType := generator.ColumnType{ID: val.Id, Type: val.Name}
-		database.SQL.FirstOrCreate(&colType)
+		colType := generator.ColumnType{}
+		if err := database.SQL.FirstOrCreate(&colType, generator.ColumnType{Type: val.Name}).Error; err != nil {
+			return &generator.GenerationError{Op: "upsert field type", Err: err}
+		}
+		typeIDs[val.Id] = colType.ID
 	}
 
-	for i, val := range app.Entities {
-		entity := generator.Entity{
-			Name:        app.Entities[i].Name,
-			DisplayName: app.Entities[i].DisplayName,
-		}
+	for _, val := range app.Entities {
 
-		err := database.SQL.Create(&entity).Error
-		if err == nil {
+		//entities and columns upserted by a previous run get the options of the config
+		entity := generator.Entity{}
+		if err := database.SQL.FirstOrCreate(&entity, generator.Entity{Name: val.Name}).Error; err != nil {
+			return &generator.GenerationError{Op: "upsert entity", Entity: val.Name, Err: err}
+		}
+		err := database.SQL.Model(&entity).Updates(map[string]interface{}{
+			"display_name": val.DisplayName,
+			"timestamps":   val.Timestamps,
+			"soft_delete":  val.SoftDelete,
+			"versioned":    val.Versioned,
+		}).Error
+		if err != nil {
+			return &generator.GenerationError{Op: "upsert entity", Entity: entity.Name, Err: err}
+		}
 
-			//since gorm has no full proof way to add foreign key constraint for all db types,
-			//manually checking if tables are created only then
-			//add columns for those entities
+		//since gorm has no full proof way to add foreign key constraint for all db types,
+		//manually checking if tables are created only then
+		//add columns for those entities
 
-			for j := range val.Fields {
-				col := generator.Column{
-					Name:        val.Fields[j].Name,
-					DisplayName: val.Fields[j].DisplayName,
-					TypeID:      val.Fields[j].Type,
-					Size:        val.Fields[j].Size,
-					EntityID:    entity.ID,
-				}
-				database.SQL.Create(&col)
+		for _, field := range val.Fields {
+			col := generator.Column{}
+			if err := database.SQL.FirstOrCreate(&col, generator.Column{EntityID: entity.ID, Name: field.Name}).Error; err != nil {
+				return &generator.GenerationError{Op: "upsert column", Entity: entity.Name, Column: field.Name, Err: err}
+			}
+			err := database.SQL.Model(&col).Updates(map[string]interface{}{
+				"display_name": field.DisplayName,
+				"type_id":      typeIDs[field.Type],
+				"size":         field.Size,
+				"primary_key":  field.PrimaryKey,
+				"nullable":     field.Nullable,
+				"not_null":     field.NotNull,
+				"unique":       field.Unique,
+				"default":      field.Default,
+				"index":        field.Index,
+				"unique_index": field.UniqueIndex,
+				"values":       strings.Join(field.Values, ","),
+				"required":     field.Required,
+				"min_length":   field.MinLength,
+				"max_length":   field.MaxLength,
+				"min":          field.Min,
+				"max":          field.Max,
+				"pattern":      field.Pattern,
+				"format":       field.Format,
+			}).Error
+			if err != nil {
+				return &generator.GenerationError{Op: "upsert column", Entity: entity.Name, Column: col.Name, Err: err}
 			}
 		}
 	}
@@ -88,28 +207,63 @@ func upsertSampleData() {
 		parentErr := database.SQL.First(&parent, "name=(?)", val.ParentEntity).Error
 		childErr := database.SQL.First(&child, "name=(?)", val.ChildEntity).Error
 
-		if parentErr != nil || childErr != nil {
-			return
+		if parentErr != nil {
+			return relationError(val, val.ParentEntity, "", parentErr)
+		}
+		if childErr != nil {
+			return relationError(val, val.ChildEntity, "", childErr)
 		}
 
 		parentFieldErr := database.SQL.First(&parentField, "name=(?) AND entity_id=(?)", val.ParentEntityField, parent.ID).Error
 		childFieldErr := database.SQL.First(&childField, "name=(?) AND entity_id=(?)", val.ChildEntityField, child.ID).Error
 
-		if parentFieldErr != nil || childFieldErr != nil {
-			return
+		if parentFieldErr != nil {
+			return relationError(val, val.ParentEntity, val.ParentEntityField, parentFieldErr)
+		}
+		if childFieldErr != nil {
+			return relationError(val, val.ChildEntity, val.ChildEntityField, childFieldErr)
+		}
+
+		var interEntityID int
+		if val.Pivot != "" {
+			inter := generator.Entity{}
+			if err := database.SQL.First(&inter, "name=(?)", val.Pivot).Error; err != nil {
+				return relationError(val, val.Pivot, "", err)
+			}
+			interEntityID = inter.ID
 		}
 
-		relation := generator.Relation{
+		//relations upserted by a previous run are found by the columns they relate and get the type and pivot of the config
+		relation := generator.Relation{}
+		err := database.SQL.FirstOrCreate(&relation, generator.Relation{
 			ParentEntityID:    parent.ID,
 			ParentEntityColID: parentField.ID,
 			ChildEntityID:     child.ID,
 			ChildEntityColID:  childField.ID,
-			RelationTypeID:    app.Relations[k].Type,
+		}).Error
+		if err != nil {
+			return relationError(val, val.ParentEntity, "", err)
+		}
+		err = database.SQL.Model(&relation).Updates(map[string]interface{}{
+			"relation_type_id": app.Relations[k].Type,
+			"inter_entity_id":  interEntityID,
+		}).Error
+		if err != nil {
+			return relationError(val, val.ParentEntity, "", err)
 		}
-
-		database.SQL.Create(&relation)
 	}
 
+	return nil
+}
+
+func relationError(relation appinfo.Relation, entity string, column string, err error) error {
+	return &generator.GenerationError{
+		Op:       "upsert relation",
+		Entity:   entity,
+		Column:   column,
+		Relation: generator.RelationName(relation),
+		Err:      err,
+	}
 }
 
 func upsertRelationTypes() {